@@ -0,0 +1,30 @@
+package bongo
+
+import "labix.org/v2/mgo/bson"
+
+// Adapter is the minimal set of operations cascade.go needs against a
+// collection. CascadeConfig.Collection satisfies it through the collection's
+// Adapter() method, which lets cascade logic run against anything that
+// implements it - the bundled mgo adapter, the mongo-driver adapter, or a
+// test fake - instead of being hard-wired to labix.org/v2/mgo.
+type Adapter interface {
+	// UpdateAll applies update to every document matching query and reports
+	// how many were touched.
+	UpdateAll(query bson.M, update bson.M) (*ChangeInfo, error)
+
+	// Find returns every document matching query, decoded into results
+	// (which must be a pointer to a slice).
+	Find(query bson.M, results interface{}) error
+
+	// Insert adds one or more documents to the underlying collection.
+	Insert(docs ...interface{}) error
+}
+
+// ChangeInfo reports the effect of an Adapter write, mirroring mgo's
+// ChangeInfo so existing callers that inspect Updated/Removed don't need to
+// change when the adapter underneath them does.
+type ChangeInfo struct {
+	Updated int
+	Removed int
+	Matched int
+}
@@ -0,0 +1,210 @@
+package bongo
+
+import (
+	"context"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// DriverAdapter is an Adapter backed by the official go.mongodb.org/mongo-driver
+// client, for projects that have moved off the abandoned labix.org/v2/mgo
+// import path. It translates the bson.M/bson.ObjectId shapes CascadeConfig
+// already speaks into the driver's primitive.M/primitive.ObjectID on the way
+// in, and translates Find results back on the way out, so callers on either
+// side of the Adapter interface never have to know which driver is under it.
+type DriverAdapter struct {
+	Collection *mongo.Collection
+
+	// Context is used for every call. Defaults to context.Background() if
+	// left nil.
+	Context context.Context
+}
+
+// NewDriverAdapter wraps a *mongo.Collection as an Adapter.
+func NewDriverAdapter(coll *mongo.Collection) *DriverAdapter {
+	return &DriverAdapter{Collection: coll}
+}
+
+func (a *DriverAdapter) ctx() context.Context {
+	if a.Context != nil {
+		return a.Context
+	}
+	return context.Background()
+}
+
+func (a *DriverAdapter) UpdateAll(query bson.M, update bson.M) (*ChangeInfo, error) {
+	res, err := a.Collection.UpdateMany(a.ctx(), translateBsonM(query), translateBsonM(update))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChangeInfo{
+		Updated: int(res.ModifiedCount),
+		Matched: int(res.MatchedCount),
+	}, nil
+}
+
+func (a *DriverAdapter) Find(query bson.M, results interface{}) error {
+	cur, err := a.Collection.Find(a.ctx(), translateBsonM(query))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(a.ctx())
+
+	if err := cur.All(a.ctx(), results); err != nil {
+		return err
+	}
+
+	untranslateResults(results)
+	return nil
+}
+
+func (a *DriverAdapter) Insert(docs ...interface{}) error {
+	translated := make([]interface{}, len(docs))
+	for i, d := range docs {
+		translated[i] = translateValue(d)
+	}
+
+	_, err := a.Collection.InsertMany(a.ctx(), translated)
+	return err
+}
+
+// translateBsonM recursively converts a labix.org/v2/mgo/bson.M (and any
+// bson.ObjectId values or nested bson.M within it) into the primitive types
+// the official driver expects.
+func translateBsonM(m bson.M) primitive.M {
+	if m == nil {
+		return nil
+	}
+
+	out := make(primitive.M, len(m))
+	for k, v := range m {
+		out[k] = translateValue(v)
+	}
+
+	return out
+}
+
+func translateValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.ObjectId:
+		if !val.Valid() {
+			return nil
+		}
+		oid, err := primitive.ObjectIDFromHex(val.Hex())
+		if err != nil {
+			return val.Hex()
+		}
+		return oid
+	case bson.M:
+		return translateBsonM(val)
+	case map[string]interface{}:
+		out := make(primitive.M, len(val))
+		for k, v := range val {
+			out[k] = translateValue(v)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = translateValue(item)
+		}
+		return out
+	case bson.D:
+		out := make(primitive.D, len(val))
+		for i, el := range val {
+			out[i] = primitive.E{Key: el.Name, Value: translateValue(el.Value)}
+		}
+		return out
+	default:
+		// Catches typed slices that don't match []interface{} above, most
+		// importantly []bson.ObjectId in an $in query - a query like
+		// {fk: {$in: []bson.ObjectId{...}}} would otherwise hand the driver
+		// raw labix ObjectIds it doesn't know how to marshal.
+		rv := reflect.ValueOf(v)
+		if rv.IsValid() && (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && rv.Type().Elem().Kind() != reflect.Uint8 {
+			out := make([]interface{}, rv.Len())
+			for i := 0; i < rv.Len(); i++ {
+				out[i] = translateValue(rv.Index(i).Interface())
+			}
+			return out
+		}
+
+		return v
+	}
+}
+
+// untranslateValue reverses translateValue: it converts the primitive types
+// the official driver decoded a query result into back into the
+// labix.org/v2/mgo/bson shapes every existing caller - Preload's foreignIdOf
+// and docId, CascadeDelete, and so on - asserts against. Without this, a read
+// through DriverAdapter hands back primitive.ObjectID where callers expect
+// bson.ObjectId and the type assertion just silently fails.
+func untranslateValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case primitive.ObjectID:
+		return bson.ObjectIdHex(val.Hex())
+	case primitive.M:
+		out := make(bson.M, len(val))
+		for k, v := range val {
+			out[k] = untranslateValue(v)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(bson.M, len(val))
+		for k, v := range val {
+			out[k] = untranslateValue(v)
+		}
+		return out
+	case primitive.A:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = untranslateValue(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = untranslateValue(item)
+		}
+		return out
+	case primitive.D:
+		out := make(bson.M, len(val))
+		for _, el := range val {
+			out[el.Key] = untranslateValue(el.Value)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// untranslateResults walks the slice Find just decoded into - a *[]bson.M,
+// the shape every existing Adapter caller passes as results - and
+// untranslates every value in place, so a DriverAdapter read returns the
+// same bson.ObjectId/bson.M shapes an MgoAdapter read would.
+func untranslateResults(results interface{}) {
+	rv := reflect.ValueOf(results)
+	if rv.Kind() != reflect.Ptr {
+		return
+	}
+	rv = rv.Elem()
+	if rv.Kind() != reflect.Slice {
+		return
+	}
+
+	for i := 0; i < rv.Len(); i++ {
+		el := rv.Index(i)
+		if el.Kind() != reflect.Map {
+			continue
+		}
+
+		for _, key := range el.MapKeys() {
+			el.SetMapIndex(key, reflect.ValueOf(untranslateValue(el.MapIndex(key).Interface())))
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package bongo
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// MgoAdapter is the legacy Adapter backed by labix.org/v2/mgo. Existing
+// Collections keep using this by default, so nothing changes for callers
+// that haven't opted into the mongo-driver adapter.
+type MgoAdapter struct {
+	Collection *mgo.Collection
+}
+
+// NewMgoAdapter wraps an *mgo.Collection as an Adapter.
+func NewMgoAdapter(coll *mgo.Collection) *MgoAdapter {
+	return &MgoAdapter{Collection: coll}
+}
+
+// Adapter returns the Adapter this collection's cascade configs fall back to
+// when a CascadeConfig doesn't set one explicitly - an MgoAdapter wrapping
+// c.Collection().
+func (c *Collection) Adapter() Adapter {
+	return NewMgoAdapter(c.Collection())
+}
+
+func (a *MgoAdapter) UpdateAll(query bson.M, update bson.M) (*ChangeInfo, error) {
+	info, err := a.Collection.UpdateAll(query, update)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChangeInfo{
+		Updated: info.Updated,
+		Removed: info.Removed,
+		Matched: info.Matched,
+	}, nil
+}
+
+func (a *MgoAdapter) Find(query bson.M, results interface{}) error {
+	return a.Collection.Find(query).All(results)
+}
+
+func (a *MgoAdapter) Insert(docs ...interface{}) error {
+	return a.Collection.Insert(docs...)
+}
@@ -0,0 +1,462 @@
+package bongo
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/oleiade/reflections"
+	"labix.org/v2/mgo/bson"
+)
+
+// Association describes a relationship from one collection to another,
+// declared once via HasMany/HasOne/BelongsTo instead of hand-rolled in every
+// document's GetCascade().
+type Association struct {
+	// Name is how the association is addressed, e.g. in Preload("comments").
+	Name string
+
+	// RelType is REL_MANY for HasMany, REL_ONE for HasOne/BelongsTo.
+	RelType int
+
+	// ForeignKey is the property that ties the two sides together. For
+	// HasMany/HasOne it's the property on Target pointing back at this
+	// collection's documents ("PostId" on Comment for a Post's
+	// HasMany("comments", "PostId", commentsColl)). For BelongsTo it's the
+	// property on *this* collection's own documents, pointing at Target's
+	// _id ("AuthorId" on Post for a BelongsTo("author", "AuthorId", usersColl)).
+	ForeignKey string
+
+	// Target is the collection the association points to.
+	Target *Collection
+
+	// belongsTo is true when the association was declared with BelongsTo,
+	// meaning ForeignKey lives on *this* document rather than on Target.
+	belongsTo bool
+}
+
+var (
+	associationsMu sync.RWMutex
+	associations   = map[*Collection]map[string]*Association{}
+)
+
+func registerAssociation(c *Collection, assoc *Association) {
+	associationsMu.Lock()
+	defer associationsMu.Unlock()
+
+	if associations[c] == nil {
+		associations[c] = make(map[string]*Association)
+	}
+
+	associations[c][assoc.Name] = assoc
+}
+
+// Associations returns every association declared on c via
+// HasMany/HasOne/BelongsTo.
+func (c *Collection) Associations() map[string]*Association {
+	associationsMu.RLock()
+	defer associationsMu.RUnlock()
+
+	return associations[c]
+}
+
+// HasMany declares that documents in target have a ForeignKey property
+// pointing back at this collection's documents, and registers it under
+// name so it can be cascaded and preloaded.
+func (c *Collection) HasMany(name string, foreignKey string, target *Collection) *Association {
+	assoc := &Association{
+		Name:       name,
+		RelType:    REL_MANY,
+		ForeignKey: foreignKey,
+		Target:     target,
+	}
+
+	registerAssociation(c, assoc)
+	return assoc
+}
+
+// HasOne declares that a single document in target has a ForeignKey
+// property pointing back at this collection's documents.
+func (c *Collection) HasOne(name string, foreignKey string, target *Collection) *Association {
+	assoc := &Association{
+		Name:       name,
+		RelType:    REL_ONE,
+		ForeignKey: foreignKey,
+		Target:     target,
+	}
+
+	registerAssociation(c, assoc)
+	return assoc
+}
+
+// BelongsTo declares that this collection's documents have a ForeignKey
+// property pointing at a document in target - the inverse of HasOne/HasMany.
+func (c *Collection) BelongsTo(name string, foreignKey string, target *Collection) *Association {
+	assoc := &Association{
+		Name:       name,
+		RelType:    REL_ONE,
+		ForeignKey: foreignKey,
+		Target:     target,
+		belongsTo:  true,
+	}
+
+	registerAssociation(c, assoc)
+	return assoc
+}
+
+// CascadeConfig derives the CascadeConfig that CascadeSave/CascadeDelete need
+// to propagate doc's id (and, for HasMany/HasOne, its through-prop) to the
+// associated collection - the thing users previously had to build by hand
+// in GetCascade(). BelongsTo has nothing to push: the foreign key already
+// lives on this side, so it returns nil.
+func (a *Association) CascadeConfig(id bson.ObjectId) *CascadeConfig {
+	if a.belongsTo {
+		return nil
+	}
+
+	return &CascadeConfig{
+		Collection:  a.Target,
+		RelType:     a.RelType,
+		ThroughProp: a.ForeignKey,
+		Query:       bson.M{a.ForeignKey: id},
+	}
+}
+
+// cascadeConfigsFromAssociations builds the CascadeConfig list for every
+// association registered on c. CascadeSave/CascadeDelete call this (via
+// collectCascadeConfigs in cascade.go) for any document that exposes its
+// collection through GetCollection(), so HasMany/HasOne/BelongsTo actually
+// drive cascading instead of only existing as a DSL.
+func cascadeConfigsFromAssociations(c *Collection, id bson.ObjectId) []*CascadeConfig {
+	configs := make([]*CascadeConfig, 0)
+
+	for _, assoc := range c.Associations() {
+		if conf := assoc.CascadeConfig(id); conf != nil {
+			configs = append(configs, conf)
+		}
+	}
+
+	return configs
+}
+
+// Preload eager-loads the given (possibly dotted, e.g. "comments.author")
+// association paths, decodes rs into out (a pointer to a slice, the same
+// shape rs.All(out) expects), and hydrates each preloaded association onto
+// its matching element of out.
+func (rs *ResultSet) Preload(out interface{}, paths ...string) error {
+	if err := rs.All(out); err != nil {
+		return err
+	}
+
+	if rs.Collection == nil || len(paths) == 0 {
+		return nil
+	}
+
+	return resolvePreloads(rs.Collection, sliceToInterfaces(out), paths)
+}
+
+// sliceToInterfaces turns *[]T (or *[]*T) into []interface{} holding each
+// element, so resolvePreloads can hydrate them generically.
+func sliceToInterfaces(out interface{}) []interface{} {
+	v := reflect.ValueOf(out)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	docs := make([]interface{}, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		el := v.Index(i)
+		if el.Kind() != reflect.Ptr && el.CanAddr() {
+			el = el.Addr()
+		}
+		docs[i] = el.Interface()
+	}
+
+	return docs
+}
+
+// resolvePreloads runs one batched $in query per preload path against the
+// association's target collection and hydrates the result onto each doc in
+// docs. A dotted path like "comments.author" recurses onto the typed structs
+// preloadOne just hydrated (e.g. each doc's now-populated Comments field),
+// not the raw query results, so the nested hydrateAssociation call has real
+// addressable structs to decode into and foreign keys to read by Go field
+// name rather than guessing at bson key casing.
+func resolvePreloads(source *Collection, docs []interface{}, paths []string) error {
+	for _, path := range paths {
+		name, rest := splitFirstDot(path)
+
+		assoc, ok := source.Associations()[name]
+		if !ok {
+			return fmt.Errorf("bongo: no association %q registered on this collection to preload", name)
+		}
+
+		if err := preloadOne(docs, name, assoc); err != nil {
+			return err
+		}
+
+		if rest != "" {
+			nested, err := hydratedAssociationTargets(docs, name, assoc)
+			if err != nil {
+				return err
+			}
+
+			if err := resolvePreloads(assoc.Target, nested, []string{rest}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// preloadOne resolves a single association for every doc in docs and
+// hydrates it onto each doc's corresponding struct field.
+func preloadOne(docs []interface{}, name string, assoc *Association) error {
+	if assoc.belongsTo {
+		// The foreign key lives on each source doc, pointing at Target's
+		// _id - the inverse of HasMany/HasOne's "query Target by foreign
+		// key, bucket by foreign key".
+		foreignIds := make([]bson.ObjectId, 0, len(docs))
+		for _, doc := range docs {
+			if id, ok := foreignIdOf(doc, assoc.ForeignKey); ok {
+				foreignIds = append(foreignIds, id)
+			}
+		}
+
+		related := make([]bson.M, 0)
+		if err := assoc.Target.Adapter().Find(bson.M{"_id": bson.M{"$in": foreignIds}}, &related); err != nil {
+			return err
+		}
+
+		byTarget := make(map[bson.ObjectId]bson.M, len(related))
+		for _, r := range related {
+			if tid, ok := r["_id"].(bson.ObjectId); ok {
+				byTarget[tid] = r
+			}
+		}
+
+		for _, doc := range docs {
+			id, ok := foreignIdOf(doc, assoc.ForeignKey)
+			if !ok {
+				continue
+			}
+			if r, ok := byTarget[id]; ok {
+				if err := hydrateAssociation(doc, name, assoc, []bson.M{r}); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	ids := make([]bson.ObjectId, 0, len(docs))
+	for _, doc := range docs {
+		id, err := docId(doc)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	related := make([]bson.M, 0)
+	if err := assoc.Target.Adapter().Find(bson.M{assoc.ForeignKey: bson.M{"$in": ids}}, &related); err != nil {
+		return err
+	}
+
+	byParent := make(map[bson.ObjectId][]bson.M)
+	for _, r := range related {
+		if parentId, ok := r[assoc.ForeignKey].(bson.ObjectId); ok {
+			byParent[parentId] = append(byParent[parentId], r)
+		}
+	}
+
+	for _, doc := range docs {
+		id, _ := docId(doc)
+		if err := hydrateAssociation(doc, name, assoc, byParent[id]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hydratedAssociationTargets reads the struct field hydrateAssociation just
+// populated (e.g. doc.Comments for name "comments") back off each doc, as
+// addressable pointers a nested Preload segment can hydrate further
+// associations onto. Unlike the bson.M preloadOne fetched off the wire,
+// these are the real typed structs, so a dotted path like "comments.author"
+// resolves against actual Go field names instead of raw bson keys.
+func hydratedAssociationTargets(docs []interface{}, name string, assoc *Association) ([]interface{}, error) {
+	field := strings.ToUpper(name[:1]) + name[1:]
+
+	nested := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		v := reflect.ValueOf(doc)
+		if v.Kind() != reflect.Ptr {
+			return nil, fmt.Errorf("bongo: cannot preload nested %q onto a non-pointer %T", name, doc)
+		}
+		v = v.Elem()
+
+		structField := v.FieldByName(field)
+		if !structField.IsValid() {
+			continue
+		}
+
+		if assoc.RelType == REL_ONE {
+			switch {
+			case structField.Kind() == reflect.Ptr:
+				if !structField.IsNil() {
+					nested = append(nested, structField.Interface())
+				}
+			case structField.CanAddr():
+				nested = append(nested, structField.Addr().Interface())
+			}
+			continue
+		}
+
+		for i := 0; i < structField.Len(); i++ {
+			el := structField.Index(i)
+			if el.Kind() == reflect.Ptr {
+				nested = append(nested, el.Interface())
+			} else if el.CanAddr() {
+				nested = append(nested, el.Addr().Interface())
+			}
+		}
+	}
+
+	return nested, nil
+}
+
+func splitFirstDot(s string) (head string, rest string) {
+	if idx := indexOfDot(s); idx >= 0 {
+		return s[:idx], s[idx+1:]
+	}
+	return s, ""
+}
+
+func indexOfDot(s string) int {
+	for i, r := range s {
+		if r == '.' {
+			return i
+		}
+	}
+	return -1
+}
+
+// docId reads the Id field off doc via reflection (for a decoded struct) or
+// the "_id" key directly (for a bare bson.M), matching how CascadeDelete
+// already identifies documents.
+func docId(doc interface{}) (bson.ObjectId, error) {
+	if m, ok := doc.(bson.M); ok {
+		id, ok := m["_id"].(bson.ObjectId)
+		if !ok {
+			return "", errors.New("bongo: document has no _id")
+		}
+		return id, nil
+	}
+
+	id, err := reflections.GetField(doc, "Id")
+	if err != nil {
+		return "", err
+	}
+
+	bsonId, ok := id.(bson.ObjectId)
+	if !ok {
+		return "", errors.New("bongo: document Id is not a bson.ObjectId")
+	}
+
+	return bsonId, nil
+}
+
+// foreignIdOf reads a BelongsTo foreign key field off doc - the Go field
+// name for a decoded struct, or the raw bson key for a bson.M.
+func foreignIdOf(doc interface{}, foreignKey string) (bson.ObjectId, bool) {
+	if m, ok := doc.(bson.M); ok {
+		id, ok := m[foreignKey].(bson.ObjectId)
+		return id, ok
+	}
+
+	v, err := reflections.GetField(doc, foreignKey)
+	if err != nil {
+		return "", false
+	}
+
+	id, ok := v.(bson.ObjectId)
+	return id, ok
+}
+
+// hydrateAssociation decodes related into the type of doc's field for the
+// given association name - by convention the exported, title-cased form of
+// name, e.g. Preload("comments") hydrates doc.Comments - so callers get back
+// real, typed nested structs instead of raw bson.M.
+func hydrateAssociation(doc interface{}, name string, assoc *Association, related []bson.M) error {
+	field := strings.ToUpper(name[:1]) + name[1:]
+
+	v := reflect.ValueOf(doc)
+	if v.Kind() != reflect.Ptr {
+		return fmt.Errorf("bongo: cannot preload %q onto a non-pointer %T", name, doc)
+	}
+	v = v.Elem()
+
+	structField := v.FieldByName(field)
+	if !structField.IsValid() || !structField.CanSet() {
+		return fmt.Errorf("bongo: preload target has no settable field %q for association %q", field, name)
+	}
+
+	if assoc.RelType == REL_ONE {
+		if len(related) == 0 {
+			return nil
+		}
+
+		val, err := decodeBsonMInto(related[0], structField.Type())
+		if err != nil {
+			return err
+		}
+
+		structField.Set(reflect.ValueOf(val))
+		return nil
+	}
+
+	slice := reflect.MakeSlice(structField.Type(), 0, len(related))
+	for _, r := range related {
+		val, err := decodeBsonMInto(r, structField.Type().Elem())
+		if err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, reflect.ValueOf(val))
+	}
+
+	structField.Set(slice)
+	return nil
+}
+
+// decodeBsonMInto marshals data back to bson and unmarshals it into a fresh
+// value of type t (which may itself be a pointer type, e.g. *Comment), so a
+// preloaded association lands on the struct as the real document type.
+func decodeBsonMInto(data bson.M, t reflect.Type) (interface{}, error) {
+	raw, err := bson.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	isPtr := t.Kind() == reflect.Ptr
+	elemType := t
+	if isPtr {
+		elemType = t.Elem()
+	}
+
+	ptr := reflect.New(elemType)
+	if err := bson.Unmarshal(raw, ptr.Interface()); err != nil {
+		return nil, err
+	}
+
+	if isPtr {
+		return ptr.Interface(), nil
+	}
+
+	return ptr.Elem().Interface(), nil
+}
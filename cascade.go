@@ -4,7 +4,6 @@ import (
 	"errors"
 	"github.com/maxwellhealth/dotaccess"
 	"github.com/oleiade/reflections"
-	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"strings"
 )
@@ -40,93 +39,138 @@ type CascadeConfig struct {
 
 	// An instance of the related doc if it needs to be nested
 	Instance interface{}
+
+	// Adapter is the Adapter cascade writes for this config are sent
+	// through by cascadeSaveWithConfig and cascadeDeleteWithConfig (and so
+	// by CascadeSave, CascadeDelete and CascadeWatcher). Defaults to an
+	// MgoAdapter wrapping Collection.Collection() when left nil, so existing
+	// configs keep working unchanged. SaveWithCascade and CascadeSaveTxn do
+	// not use it: they write through Collection.Collection() directly.
+	Adapter Adapter
+
+	// compiled holds one resolved fieldPath per entry in Properties, set by
+	// Collection.RegisterCascade. Left nil for configs that were never
+	// registered, in which case cascadeSaveWithConfig falls back to
+	// splitting Properties at save time.
+	compiled []*fieldPath
 }
 
-// Cascades a document's properties to related documents, after it has been prepared
-// for db insertion (encrypted, etc)
-func CascadeSave(doc interface{}, preparedForSave map[string]interface{}) {
-	// Find out which properties to cascade
+// adapter returns conf.Adapter if one was set, falling back to the legacy
+// mgo adapter wrapping conf.Collection so callers that predate the Adapter
+// interface don't have to change.
+func (conf *CascadeConfig) adapter() Adapter {
+	if conf.Adapter != nil {
+		return conf.Adapter
+	}
+
+	return NewMgoAdapter(conf.Collection.Collection())
+}
+
+// collectCascadeConfigs gathers the configs a document wants cascaded: the
+// ones it hand-builds in GetCascade() (if it implements that interface),
+// plus whatever HasMany/HasOne/BelongsTo declared on its collection (if it
+// implements GetCollection()), so the association DSL actually drives
+// cascading instead of only existing as a separate API.
+func collectCascadeConfigs(doc interface{}) []*CascadeConfig {
+	configs := make([]*CascadeConfig, 0)
+
 	if conv, ok := doc.(interface {
 		GetCascade() []*CascadeConfig
 	}); ok {
-		toCascade := conv.GetCascade()
+		configs = append(configs, conv.GetCascade()...)
+	}
 
-		for _, conf := range toCascade {
-			cascadeSaveWithConfig(conf, preparedForSave)
+	if withColl, ok := doc.(interface {
+		GetCollection() *Collection
+	}); ok {
+		if rawId, err := reflections.GetField(doc, "Id"); err == nil {
+			if bsonId, ok := rawId.(bson.ObjectId); ok {
+				configs = append(configs, cascadeConfigsFromAssociations(withColl.GetCollection(), bsonId)...)
+			}
+		}
+	}
 
-			if conf.Nest {
-				results := conf.Collection.Find(conf.Query)
+	return configs
+}
 
-				for results.Next(conf.Instance) {
-					prepared := conf.Collection.PrepDocumentForSave(conf.Instance)
-					CascadeSave(conf.Instance, prepared)
-				}
+// Cascades a document's properties to related documents, after it has been prepared
+// for db insertion (encrypted, etc)
+func CascadeSave(doc interface{}, preparedForSave map[string]interface{}) {
+	for _, conf := range collectCascadeConfigs(doc) {
+		cascadeSaveWithConfig(conf, preparedForSave)
+
+		if conf.Nest {
+			results := conf.Collection.Find(conf.Query)
 
+			for results.Next(conf.Instance) {
+				prepared := conf.Collection.PrepDocumentForSave(conf.Instance)
+				CascadeSave(conf.Instance, prepared)
 			}
+
 		}
 	}
 }
 
 // Deletes references to a document from its related documents
 func CascadeDelete(doc interface{}) {
-	// Find out which properties to cascade
-	if conv, ok := doc.(interface {
-		GetCascade() []*CascadeConfig
-	}); ok {
-		toCascade := conv.GetCascade()
+	toCascade := collectCascadeConfigs(doc)
+	if len(toCascade) == 0 {
+		return
+	}
 
-		// Get the ID
-		id, err := reflections.GetField(doc, "Id")
+	// Get the ID
+	id, err := reflections.GetField(doc, "Id")
 
-		if err != nil {
-			panic(err)
-		}
+	if err != nil {
+		panic(err)
+	}
 
-		// Cast as bson.ObjectId
-		if bsonId, ok := id.(bson.ObjectId); ok {
-			for _, conf := range toCascade {
-				cascadeDeleteWithConfig(conf, bsonId)
-			}
+	// Cast as bson.ObjectId
+	if bsonId, ok := id.(bson.ObjectId); ok {
+		for _, conf := range toCascade {
+			cascadeDeleteWithConfig(conf, bsonId)
 		}
-
 	}
 }
 
 // Runs a cascaded delete operation with one configuration
-func cascadeDeleteWithConfig(conf *CascadeConfig, id bson.ObjectId) (*mgo.ChangeInfo, error) {
+func cascadeDeleteWithConfig(conf *CascadeConfig, id bson.ObjectId) (*ChangeInfo, error) {
 	switch conf.RelType {
 	case REL_ONE:
-		update := map[string]map[string]interface{}{
-			"$set": map[string]interface{}{},
+		update := bson.M{
+			"$set": bson.M{},
 		}
 
 		if len(conf.ThroughProp) > 0 {
-			update["$set"][conf.ThroughProp] = nil
+			update["$set"].(bson.M)[conf.ThroughProp] = nil
 		} else {
 			for _, p := range conf.Properties {
-				update["$set"][p] = nil
+				update["$set"].(bson.M)[p] = nil
 			}
 		}
 
-		return conf.Collection.Collection().UpdateAll(conf.Query, update)
+		return conf.adapter().UpdateAll(conf.Query, update)
 	case REL_MANY:
-		update := map[string]map[string]interface{}{
-			"$pull": map[string]interface{}{},
+		update := bson.M{
+			"$pull": bson.M{},
 		}
 
-		update["$pull"][conf.ThroughProp] = bson.M{
+		update["$pull"].(bson.M)[conf.ThroughProp] = bson.M{
 			"_id": id,
 		}
-		return conf.Collection.Collection().UpdateAll(conf.Query, update)
+		return conf.adapter().UpdateAll(conf.Query, update)
 	}
 
-	return &mgo.ChangeInfo{}, errors.New("Invalid relation type")
+	return &ChangeInfo{}, errors.New("Invalid relation type")
 }
 
-// Runs a cascaded save operation with one configuration
-func cascadeSaveWithConfig(conf *CascadeConfig, preparedForSave map[string]interface{}) (*mgo.ChangeInfo, error) {
-	// Create a new map with just the props to cascade
-
+// buildCascadeData projects preparedForSave down to conf.Properties (which
+// may use dot notation), prefixed with "_id" when conf has a ThroughProp.
+// Every path that stages a cascaded write - the eager path below, the bulk
+// path in cascade_bulk.go, and the staged/txn path in cascade_txn.go - goes
+// through this so they can't silently diverge on how dotted properties, or a
+// compiled RegisterCascade fieldPath, are resolved.
+func buildCascadeData(conf *CascadeConfig, preparedForSave map[string]interface{}) map[string]interface{} {
 	id := preparedForSave["_id"]
 
 	data := make(map[string]interface{})
@@ -135,96 +179,114 @@ func cascadeSaveWithConfig(conf *CascadeConfig, preparedForSave map[string]inter
 		data["_id"] = id
 	}
 
-	for _, prop := range conf.Properties {
-		split := strings.Split(prop, ".")
+	if conf.compiled != nil {
+		// Registered via Collection.RegisterCascade: read straight off the
+		// cached fieldPath instead of re-splitting Properties and
+		// re-walking dot notation on every save.
+		for i, prop := range conf.Properties {
+			value, _ := readFieldPath(preparedForSave, conf.compiled[i])
+			setDotted(data, prop, value)
+		}
+	} else {
+		for _, prop := range conf.Properties {
+			split := strings.Split(prop, ".")
 
-		if len(split) == 1 {
-			data[prop] = preparedForSave[prop]
-		} else {
-			actualProp := split[len(split)-1]
-			split := append([]string{}, split[:len(split)-1]...)
-			curData := data
-
-			for _, s := range split {
-				if _, ok := curData[s]; ok {
-					if mapped, ok := curData[s].(map[string]interface{}); ok {
-						curData = mapped
-					} else {
-						panic("Cannot access non-map property via dot notationa")
-					}
+			if len(split) == 1 {
+				data[prop] = preparedForSave[prop]
+			} else {
+				actualProp := split[len(split)-1]
+				split := append([]string{}, split[:len(split)-1]...)
+				curData := data
+
+				for _, s := range split {
+					if _, ok := curData[s]; ok {
+						if mapped, ok := curData[s].(map[string]interface{}); ok {
+							curData = mapped
+						} else {
+							panic("Cannot access non-map property via dot notationa")
+						}
 
-				} else {
-					curData[s] = make(map[string]interface{})
-					if mapped, ok := curData[s].(map[string]interface{}); ok {
-						curData = mapped
 					} else {
-						panic("Cannot access non-map property via dot notationb")
+						curData[s] = make(map[string]interface{})
+						if mapped, ok := curData[s].(map[string]interface{}); ok {
+							curData = mapped
+						} else {
+							panic("Cannot access non-map property via dot notationb")
+						}
 					}
 				}
+
+				curData[actualProp], _ = dotaccess.Get(preparedForSave, prop)
 			}
 
-			curData[actualProp], _ = dotaccess.Get(preparedForSave, prop)
 		}
-
 	}
 
+	return data
+}
+
+// Runs a cascaded save operation with one configuration
+func cascadeSaveWithConfig(conf *CascadeConfig, preparedForSave map[string]interface{}) (*ChangeInfo, error) {
+	id := preparedForSave["_id"]
+	data := buildCascadeData(conf, preparedForSave)
+
 	switch conf.RelType {
 	case REL_ONE:
 		if len(conf.OldQuery) > 0 {
 
-			update1 := map[string]map[string]interface{}{
-				"$set": map[string]interface{}{},
+			update1 := bson.M{
+				"$set": bson.M{},
 			}
 
 			if len(conf.ThroughProp) > 0 {
-				update1["$set"][conf.ThroughProp] = nil
+				update1["$set"].(bson.M)[conf.ThroughProp] = nil
 			} else {
 				for _, p := range conf.Properties {
-					update1["$set"][p] = nil
+					update1["$set"].(bson.M)[p] = nil
 				}
 			}
-			conf.Collection.Collection().UpdateAll(conf.OldQuery, update1)
+			conf.adapter().UpdateAll(conf.OldQuery, update1)
 		}
 
-		update := map[string]map[string]interface{}{
-			"$set": map[string]interface{}{},
+		update := bson.M{
+			"$set": bson.M{},
 		}
 
 		if len(conf.ThroughProp) > 0 {
-			update["$set"][conf.ThroughProp] = data
+			update["$set"].(bson.M)[conf.ThroughProp] = data
 		} else {
 			for k, v := range data {
-				update["$set"][k] = v
+				update["$set"].(bson.M)[k] = v
 			}
 		}
 
 		// Just update
-		return conf.Collection.Collection().UpdateAll(conf.Query, update)
+		return conf.adapter().UpdateAll(conf.Query, update)
 	case REL_MANY:
-		update1 := map[string]map[string]interface{}{
-			"$pull": map[string]interface{}{},
+		update1 := bson.M{
+			"$pull": bson.M{},
 		}
 
-		update1["$pull"][conf.ThroughProp] = bson.M{
+		update1["$pull"].(bson.M)[conf.ThroughProp] = bson.M{
 			"_id": id,
 		}
 
 		if len(conf.OldQuery) > 0 {
-			conf.Collection.Collection().UpdateAll(conf.OldQuery, update1)
+			conf.adapter().UpdateAll(conf.OldQuery, update1)
 		}
 
 		// Remove self from current relations, so we can replace it
-		conf.Collection.Collection().UpdateAll(conf.Query, update1)
+		conf.adapter().UpdateAll(conf.Query, update1)
 
-		update2 := map[string]map[string]interface{}{
-			"$push": map[string]interface{}{},
+		update2 := bson.M{
+			"$push": bson.M{},
 		}
 
-		update2["$push"][conf.ThroughProp] = data
-		return conf.Collection.Collection().UpdateAll(conf.Query, update2)
+		update2["$push"].(bson.M)[conf.ThroughProp] = data
+		return conf.adapter().UpdateAll(conf.Query, update2)
 
 	}
 
-	return &mgo.ChangeInfo{}, errors.New("Invalid relation type")
+	return &ChangeInfo{}, errors.New("Invalid relation type")
 
 }
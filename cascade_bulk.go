@@ -0,0 +1,152 @@
+package bongo
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// cascadeContext is threaded through a single top-level SaveWithCascade
+// call (and every nested call triggered by Nest) so every UpdateAll it would
+// otherwise issue is batched into one Bulk per target collection and flushed
+// once, instead of 1-3 round trips per config that Nest then multiplies per
+// nested doc.
+type cascadeContext struct {
+	bulks  []*mgo.Bulk
+	byColl map[*mgo.Collection]*mgo.Bulk
+}
+
+func newCascadeContext() *cascadeContext {
+	return &cascadeContext{
+		byColl: make(map[*mgo.Collection]*mgo.Bulk),
+	}
+}
+
+// bulkFor returns the Bulk builder for coll, creating (and remembering the
+// order of) one on first use so flush() commits collections in the order
+// they were first touched. It's left ordered (mgo's default): a REL_MANY
+// config stages a $pull immediately followed by the $push that replaces it,
+// and an unordered bulk is free to run them out of order, which would pull
+// out the entry the $push just added.
+func (cc *cascadeContext) bulkFor(coll *mgo.Collection) *mgo.Bulk {
+	if b, ok := cc.byColl[coll]; ok {
+		return b
+	}
+
+	b := coll.Bulk()
+	cc.byColl[coll] = b
+	cc.bulks = append(cc.bulks, b)
+	return b
+}
+
+// flush runs every staged Bulk, in the order its collection was first
+// touched, and returns the first error encountered.
+func (cc *cascadeContext) flush() error {
+	for _, b := range cc.bulks {
+		if _, err := b.Run(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cascadeSaveWithConfigBulk mirrors cascadeSaveWithConfig, but stages its
+// UpdateAll calls into cc's per-collection Bulk instead of running them
+// immediately.
+func cascadeSaveWithConfigBulk(conf *CascadeConfig, preparedForSave map[string]interface{}, cc *cascadeContext) {
+	id := preparedForSave["_id"]
+	data := buildCascadeData(conf, preparedForSave)
+
+	coll := conf.Collection.Collection()
+	bulk := cc.bulkFor(coll)
+
+	switch conf.RelType {
+	case REL_ONE:
+		if len(conf.OldQuery) > 0 {
+			clear := bson.M{"$set": bson.M{}}
+			if len(conf.ThroughProp) > 0 {
+				clear["$set"].(bson.M)[conf.ThroughProp] = nil
+			} else {
+				for _, p := range conf.Properties {
+					clear["$set"].(bson.M)[p] = nil
+				}
+			}
+			bulk.UpdateAll(conf.OldQuery, clear)
+		}
+
+		update := bson.M{"$set": bson.M{}}
+		if len(conf.ThroughProp) > 0 {
+			update["$set"].(bson.M)[conf.ThroughProp] = data
+		} else {
+			for k, v := range data {
+				update["$set"].(bson.M)[k] = v
+			}
+		}
+
+		bulk.UpdateAll(conf.Query, update)
+	case REL_MANY:
+		pull := bson.M{"$pull": bson.M{conf.ThroughProp: bson.M{"_id": id}}}
+
+		if len(conf.OldQuery) > 0 {
+			bulk.UpdateAll(conf.OldQuery, pull)
+		}
+
+		bulk.UpdateAll(conf.Query, pull)
+		bulk.UpdateAll(conf.Query, bson.M{"$push": bson.M{conf.ThroughProp: data}})
+	}
+}
+
+// cascadeDeleteWithConfigBulk mirrors cascadeDeleteWithConfig, staging into
+// cc instead of executing immediately.
+func cascadeDeleteWithConfigBulk(conf *CascadeConfig, id bson.ObjectId, cc *cascadeContext) {
+	bulk := cc.bulkFor(conf.Collection.Collection())
+
+	switch conf.RelType {
+	case REL_ONE:
+		update := bson.M{"$set": bson.M{}}
+		if len(conf.ThroughProp) > 0 {
+			update["$set"].(bson.M)[conf.ThroughProp] = nil
+		} else {
+			for _, p := range conf.Properties {
+				update["$set"].(bson.M)[p] = nil
+			}
+		}
+		bulk.UpdateAll(conf.Query, update)
+	case REL_MANY:
+		bulk.UpdateAll(conf.Query, bson.M{"$pull": bson.M{conf.ThroughProp: bson.M{"_id": id}}})
+	}
+}
+
+// cascadeSaveBulk walks doc's cascade configs - both GetCascade() and any
+// HasMany/HasOne/BelongsTo associations, via collectCascadeConfigs, the same
+// way CascadeSave does - staging every write (including nested ones, when a
+// config has Nest set) into cc instead of running them eagerly.
+func cascadeSaveBulk(doc interface{}, preparedForSave map[string]interface{}, cc *cascadeContext) {
+	for _, conf := range collectCascadeConfigs(doc) {
+		cascadeSaveWithConfigBulk(conf, preparedForSave, cc)
+
+		if conf.Nest {
+			results := conf.Collection.Find(conf.Query)
+
+			for results.Next(conf.Instance) {
+				prepared := conf.Collection.PrepDocumentForSave(conf.Instance)
+				cascadeSaveBulk(conf.Instance, prepared, cc)
+			}
+		}
+	}
+}
+
+// SaveWithCascade saves doc, the normal way, then runs its entire cascade -
+// including every Nest level - as one Bulk per target collection instead of
+// a round trip per config per nested doc.
+func (c *Collection) SaveWithCascade(doc interface{}) error {
+	if err := c.Save(doc); err != nil {
+		return err
+	}
+
+	prepared := c.PrepDocumentForSave(doc)
+
+	cc := newCascadeContext()
+	cascadeSaveBulk(doc, prepared, cc)
+	return cc.flush()
+}
@@ -0,0 +1,176 @@
+package bongo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// fieldPath is a dotted CascadeConfig property ("address.city") resolved
+// once, at RegisterCascade time, into the bson keys it actually maps to -
+// honoring bson tags, embedded structs, and slices - so cascadeSaveWithConfig
+// no longer has to re-split and re-walk the string on every save.
+type fieldPath struct {
+	dotted   string
+	bsonKeys []string
+}
+
+// compileFieldPath walks t (the source document's struct type) following
+// dotted, resolving each segment to the bson key its field actually
+// serializes as. It returns a descriptive error instead of letting a typo
+// surface later as a cryptic dot-notation panic.
+func compileFieldPath(t reflect.Type, dotted string) (*fieldPath, error) {
+	segments := strings.Split(dotted, ".")
+	keys := make([]string, 0, len(segments))
+
+	cur := t
+	for _, seg := range segments {
+		cur = deref(cur)
+
+		if cur.Kind() == reflect.Slice || cur.Kind() == reflect.Array {
+			cur = deref(cur.Elem())
+		}
+
+		if cur.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("bongo: cascade property %q is invalid: %s has no fields to descend into", dotted, cur.Kind())
+		}
+
+		field, bsonKey, ok := findField(cur, seg)
+		if !ok {
+			return nil, fmt.Errorf("bongo: cascade property %q does not exist on %s", dotted, t.Name())
+		}
+
+		keys = append(keys, bsonKey)
+		cur = field.Type
+	}
+
+	return &fieldPath{dotted: dotted, bsonKeys: keys}, nil
+}
+
+func deref(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// findField looks up name (either the Go field name or its bson key) on t,
+// descending into anonymous (embedded) fields the way bson/json marshaling
+// itself does.
+func findField(t reflect.Type, name string) (reflect.StructField, string, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if f.Anonymous {
+			if embedded := deref(f.Type); embedded.Kind() == reflect.Struct {
+				if sf, key, ok := findField(embedded, name); ok {
+					return sf, key, true
+				}
+			}
+			continue
+		}
+
+		bsonKey := bsonKeyFor(f)
+		if f.Name == name || bsonKey == name {
+			return f, bsonKey, true
+		}
+	}
+
+	return reflect.StructField{}, "", false
+}
+
+// bsonKeyFor mirrors mgo/bson's default field naming: the bson tag's name
+// if set, otherwise the lowercased field name.
+func bsonKeyFor(f reflect.StructField) string {
+	tag := f.Tag.Get("bson")
+	if tag == "" {
+		return strings.ToLower(f.Name)
+	}
+
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		return strings.ToLower(f.Name)
+	}
+
+	return name
+}
+
+// readFieldPath reads the value at path out of a prepared-for-save map,
+// returning ok=false for a missing segment instead of panicking the way the
+// old strings.Split/dotaccess.Get path did. Only maps are descended into: a
+// path that crosses a slice, which compileFieldPath accepts by stepping into
+// the slice's element type, reads as missing (ok=false).
+func readFieldPath(data map[string]interface{}, path *fieldPath) (interface{}, bool) {
+	var cur interface{} = data
+
+	for _, key := range path.bsonKeys {
+		m, ok := asMap(cur)
+		if !ok {
+			return nil, false
+		}
+
+		cur, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case bson.M:
+		return map[string]interface{}(m), true
+	default:
+		return nil, false
+	}
+}
+
+// setDotted writes value into data at the nested path described by dotted,
+// creating intermediate maps as needed - the same shape the legacy
+// strings.Split path built, just without re-deriving it from the prop name
+// a second time at read time.
+func setDotted(data map[string]interface{}, dotted string, value interface{}) {
+	segments := strings.Split(dotted, ".")
+
+	cur := data
+	for _, s := range segments[:len(segments)-1] {
+		next, ok := cur[s].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			cur[s] = next
+		}
+		cur = next
+	}
+
+	cur[segments[len(segments)-1]] = value
+}
+
+// RegisterCascade validates every conf.Properties entry against doc's
+// struct shape and caches a compiled fieldPath for each, so a typo'd
+// property name is reported here instead of panicking on the first save
+// that happens to exercise it.
+func (c *Collection) RegisterCascade(doc interface{}, configs []*CascadeConfig) error {
+	t := deref(reflect.TypeOf(doc))
+
+	for _, conf := range configs {
+		compiled := make([]*fieldPath, len(conf.Properties))
+
+		for i, prop := range conf.Properties {
+			fp, err := compileFieldPath(t, prop)
+			if err != nil {
+				return err
+			}
+			compiled[i] = fp
+		}
+
+		conf.compiled = compiled
+	}
+
+	return nil
+}
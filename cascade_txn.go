@@ -0,0 +1,424 @@
+package bongo
+
+import (
+	"errors"
+	"strings"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Journal states for a staged cascade transaction, recorded on the journal
+// document for observability (so an operator can inspect how far a
+// transaction got). Nothing currently reads a journal document back to
+// resume or roll back after a process crash - rollback only runs in-process,
+// against the applied ops runCascadeTxn is still holding in memory when a
+// later op fails.
+const (
+	TxnInit    = "init"
+	TxnPending = "pending"
+	TxnApplied = "applied"
+	TxnDone    = "done"
+)
+
+// CascadeOptions carries the extra state needed to run a cascade inside a
+// transaction: the session to run every staged op on, and the collection
+// used to persist the journal document.
+type CascadeOptions struct {
+	// Session is the mgo session every staged op is executed on. All ops in
+	// a single staged cascade share this session so they see a consistent
+	// view of the data.
+	Session *mgo.Session
+
+	// JournalCollection is where the pending/applied/done journal document
+	// is written. Defaults to "_bongoCascadeTxns" on the same database as
+	// the first staged op if left nil.
+	JournalCollection *mgo.Collection
+}
+
+// GetCascadeWithContext is implemented by documents that want their cascade
+// configs resolved against a particular CascadeOptions (session, journal
+// collection) instead of the package-level defaults used by GetCascade.
+type GetCascadeWithContext interface {
+	GetCascadeWithContext(opts *CascadeOptions) []*CascadeConfig
+}
+
+// cascadeOpKind distinguishes the shape of write a staged cascadeOp makes,
+// since each shape needs a different snapshot to build a real inverse.
+type cascadeOpKind int
+
+const (
+	// opSetFields $sets Fields (a field -> new value map) on every doc
+	// matching Query - the REL_ONE path.
+	opSetFields cascadeOpKind = iota
+
+	// opPullSelf $pulls the array element {_id: Id} out of ThroughProp on
+	// every doc matching Query - half of the REL_MANY path.
+	opPullSelf
+
+	// opPushSelf $pushes Data into ThroughProp on every doc matching Query -
+	// the other half of the REL_MANY path.
+	opPushSelf
+)
+
+// cascadeOp is a single staged write, captured before it's sent to Mongo so
+// it can be journaled and, once applied, inverted using a snapshot of what
+// it actually overwrote rather than a guess.
+type cascadeOp struct {
+	Kind        cascadeOpKind
+	Collection  string
+	Query       bson.M
+	ThroughProp string        `bson:",omitempty"`
+	Fields      bson.M        `bson:",omitempty"`
+	Data        bson.M        `bson:",omitempty"`
+	Id          bson.ObjectId `bson:",omitempty"`
+
+	// priorFieldValues (opSetFields) and priorElements (opPullSelf) are
+	// filled in by applyCascadeOp right before the write, from a read of
+	// the documents it's about to touch, so rollback can restore exactly
+	// what was there rather than assuming an inverse shape up front.
+	priorFieldValues map[bson.ObjectId]bson.M
+	priorElements    map[bson.ObjectId]bson.M
+}
+
+// cascadeTxnJournal is the observability record for a staged cascade. It
+// lists every op up front (state TxnInit), is flipped to TxnPending once
+// written, moves to TxnApplied as each op in Ops is applied in order, and
+// finally to TxnDone once every op has succeeded - a trail an operator can
+// read to see how far a transaction got, not a record this package resumes
+// or rolls back from itself.
+type cascadeTxnJournal struct {
+	Id      bson.ObjectId `bson:"_id"`
+	Ops     []cascadeOp   `bson:"ops"`
+	State   string        `bson:"state"`
+	Applied int           `bson:"applied"`
+}
+
+// cascadeOpLog accumulates ops during staging instead of executing them
+// immediately, so CascadeSaveTxn can journal the whole batch before
+// touching any related document.
+type cascadeOpLog struct {
+	ops []cascadeOp
+}
+
+func (l *cascadeOpLog) stageSetFields(collection string, query bson.M, fields bson.M) {
+	l.ops = append(l.ops, cascadeOp{Kind: opSetFields, Collection: collection, Query: query, Fields: fields})
+}
+
+func (l *cascadeOpLog) stagePullSelf(collection string, query bson.M, throughProp string, id bson.ObjectId) {
+	l.ops = append(l.ops, cascadeOp{Kind: opPullSelf, Collection: collection, Query: query, ThroughProp: throughProp, Id: id})
+}
+
+func (l *cascadeOpLog) stagePushSelf(collection string, query bson.M, throughProp string, id bson.ObjectId, data bson.M) {
+	l.ops = append(l.ops, cascadeOp{Kind: opPushSelf, Collection: collection, Query: query, ThroughProp: throughProp, Id: id, Data: data})
+}
+
+// CascadeSaveTxn is the transactional counterpart to CascadeSave: every
+// related-document update triggered by doc's cascade configs is staged into
+// a journal first, then applied one by one. If any op fails partway through,
+// the ops already applied are rolled back using a snapshot of what they
+// actually overwrote, leaving the database in the state it was in before
+// CascadeSaveTxn was called. Nest is not followed: the cascades of nested
+// related documents are not staged or run.
+func CascadeSaveTxn(doc interface{}, preparedForSave map[string]interface{}, opts *CascadeOptions) error {
+	configs := cascadeConfigsForTxn(doc, opts)
+	if len(configs) == 0 {
+		return nil
+	}
+
+	log := &cascadeOpLog{}
+
+	for _, conf := range configs {
+		cascadeSaveWithConfigStaged(conf, preparedForSave, log)
+	}
+
+	return runCascadeTxn(log, opts)
+}
+
+// cascadeConfigsForTxn resolves doc's cascade configs the same way
+// collectCascadeConfigs does (GetCascade() plus any HasMany/HasOne/BelongsTo
+// associations), except a document implementing GetCascadeWithContext gets
+// opts threaded through instead, so it can vary its configs per session or
+// journal collection rather than using the package-level defaults.
+func cascadeConfigsForTxn(doc interface{}, opts *CascadeOptions) []*CascadeConfig {
+	if conv, ok := doc.(GetCascadeWithContext); ok {
+		return conv.GetCascadeWithContext(opts)
+	}
+
+	return collectCascadeConfigs(doc)
+}
+
+// SaveWithCascadeTxn saves doc, the normal way, then runs its cascade
+// transactionally: every cascaded write either all commit, or none do.
+func (c *Collection) SaveWithCascadeTxn(doc interface{}, opts *CascadeOptions) error {
+	if err := c.Save(doc); err != nil {
+		return err
+	}
+
+	prepared := c.PrepDocumentForSave(doc)
+	return CascadeSaveTxn(doc, prepared, opts)
+}
+
+// runCascadeTxn writes the journal document, applies every staged op in
+// order - recording each success as it happens, for an operator inspecting
+// the journal - and rolls back everything already applied, in-process, if
+// one of them fails. A crash mid-transaction leaves the journal at whatever
+// state it last reached; nothing reads it back to resume or roll back after
+// the fact.
+func runCascadeTxn(log *cascadeOpLog, opts *CascadeOptions) error {
+	if len(log.ops) == 0 {
+		return nil
+	}
+
+	journalColl := opts.JournalCollection
+	if journalColl == nil {
+		journalColl = opts.Session.DB("").C("_bongoCascadeTxns")
+	}
+
+	journal := &cascadeTxnJournal{
+		Id:    bson.NewObjectId(),
+		Ops:   log.ops,
+		State: TxnInit,
+	}
+
+	if err := journalColl.Insert(journal); err != nil {
+		return err
+	}
+
+	if err := journalColl.UpdateId(journal.Id, bson.M{"$set": bson.M{"state": TxnPending}}); err != nil {
+		return err
+	}
+
+	applied := 0
+	for i := range journal.Ops {
+		op := &journal.Ops[i]
+		coll := opts.Session.DB("").C(op.Collection)
+
+		if err := applyCascadeOp(coll, op); err != nil {
+			rollbackErr := rollbackCascadeTxn(opts, journal.Ops[:applied])
+			if rollbackErr != nil {
+				return errors.New("cascade txn failed and rollback also failed: " + err.Error() + "; " + rollbackErr.Error())
+			}
+			return err
+		}
+
+		applied = i + 1
+		if err := journalColl.UpdateId(journal.Id, bson.M{"$set": bson.M{"state": TxnApplied, "applied": applied}}); err != nil {
+			return err
+		}
+	}
+
+	return journalColl.UpdateId(journal.Id, bson.M{"$set": bson.M{"state": TxnDone}})
+}
+
+// applyCascadeOp snapshots whatever op is about to overwrite, then runs it.
+// The snapshot is what makes rollbackCascadeTxn an actual inverse instead of
+// a best guess.
+func applyCascadeOp(coll *mgo.Collection, op *cascadeOp) error {
+	switch op.Kind {
+	case opSetFields:
+		fields := make([]string, 0, len(op.Fields))
+		for f := range op.Fields {
+			fields = append(fields, f)
+		}
+
+		prior, err := snapshotFields(coll, op.Query, fields)
+		if err != nil {
+			return err
+		}
+		op.priorFieldValues = prior
+
+		_, err = coll.UpdateAll(op.Query, bson.M{"$set": op.Fields})
+		return err
+	case opPullSelf:
+		prior, err := snapshotArrayElement(coll, op.Query, op.ThroughProp, op.Id)
+		if err != nil {
+			return err
+		}
+		op.priorElements = prior
+
+		_, err = coll.UpdateAll(op.Query, bson.M{"$pull": bson.M{op.ThroughProp: bson.M{"_id": op.Id}}})
+		return err
+	case opPushSelf:
+		_, err := coll.UpdateAll(op.Query, bson.M{"$push": bson.M{op.ThroughProp: op.Data}})
+		return err
+	}
+
+	return errors.New("bongo: unknown cascade op kind")
+}
+
+// snapshotFields reads the current value of each field in fields, per
+// document matching query, before they're overwritten. A field absent from
+// the returned bson.M for a given id means it wasn't set on that document.
+func snapshotFields(coll *mgo.Collection, query bson.M, fields []string) (map[bson.ObjectId]bson.M, error) {
+	projection := bson.M{}
+	for _, f := range fields {
+		projection[f] = 1
+	}
+
+	var docs []bson.M
+	if err := coll.Find(query).Select(projection).All(&docs); err != nil {
+		return nil, err
+	}
+
+	snapshot := make(map[bson.ObjectId]bson.M, len(docs))
+	for _, d := range docs {
+		id, ok := d["_id"].(bson.ObjectId)
+		if !ok {
+			continue
+		}
+
+		// Key each value by the field name as given, so a dotted field like
+		// "address.city" is found under that name rather than nested.
+		prior := bson.M{}
+		for _, f := range fields {
+			if v, ok := readFieldPath(d, &fieldPath{dotted: f, bsonKeys: strings.Split(f, ".")}); ok {
+				prior[f] = v
+			}
+		}
+		snapshot[id] = prior
+	}
+
+	return snapshot, nil
+}
+
+// snapshotArrayElement reads, per document matching query, whichever element
+// of throughProp currently has _id == id - the exact sub-document a $pull is
+// about to remove - so rollback can $push the very same thing back.
+func snapshotArrayElement(coll *mgo.Collection, query bson.M, throughProp string, id bson.ObjectId) (map[bson.ObjectId]bson.M, error) {
+	var docs []bson.M
+	if err := coll.Find(query).Select(bson.M{"_id": 1, throughProp: 1}).All(&docs); err != nil {
+		return nil, err
+	}
+
+	snapshot := make(map[bson.ObjectId]bson.M, len(docs))
+	for _, d := range docs {
+		docId, ok := d["_id"].(bson.ObjectId)
+		if !ok {
+			continue
+		}
+
+		arr, _ := d[throughProp].([]interface{})
+		for _, el := range arr {
+			entry, ok := el.(bson.M)
+			if !ok {
+				continue
+			}
+			if entryId, ok := entry["_id"].(bson.ObjectId); ok && entryId == id {
+				snapshot[docId] = entry
+				break
+			}
+		}
+	}
+
+	return snapshot, nil
+}
+
+// cascadeSaveWithConfigStaged mirrors cascadeSaveWithConfig, but appends its
+// writes to log as typed ops instead of executing them, so they can be
+// journaled and applied - with a real, snapshot-based inverse - by
+// runCascadeTxn. Like the eager and bulk paths, it projects conf.Properties
+// through buildCascadeData, so a config registered via RegisterCascade gets
+// its compiled fieldPaths here too instead of re-walking (and re-panicking
+// on a typo'd) dot notation.
+func cascadeSaveWithConfigStaged(conf *CascadeConfig, preparedForSave map[string]interface{}, log *cascadeOpLog) {
+	id := preparedForSave["_id"]
+	data := buildCascadeData(conf, preparedForSave)
+
+	collName := conf.Collection.Collection().Name
+	bsonData := bson.M(data)
+
+	switch conf.RelType {
+	case REL_ONE:
+		if len(conf.OldQuery) > 0 {
+			clear := bson.M{}
+			if len(conf.ThroughProp) > 0 {
+				clear[conf.ThroughProp] = nil
+			} else {
+				for _, p := range conf.Properties {
+					clear[p] = nil
+				}
+			}
+			log.stageSetFields(collName, conf.OldQuery, clear)
+		}
+
+		set := bson.M{}
+		if len(conf.ThroughProp) > 0 {
+			set[conf.ThroughProp] = bsonData
+		} else {
+			for k, v := range data {
+				set[k] = v
+			}
+		}
+
+		log.stageSetFields(collName, conf.Query, set)
+	case REL_MANY:
+		bsonId, _ := id.(bson.ObjectId)
+
+		if len(conf.OldQuery) > 0 {
+			log.stagePullSelf(collName, conf.OldQuery, conf.ThroughProp, bsonId)
+		}
+
+		// Remove self from current relations, so we can replace it.
+		log.stagePullSelf(collName, conf.Query, conf.ThroughProp, bsonId)
+		log.stagePushSelf(collName, conf.Query, conf.ThroughProp, bsonId, bsonData)
+	}
+}
+
+// rollbackCascadeTxn undoes every op in applied, in reverse order, using
+// the snapshot each op captured right before it ran.
+func rollbackCascadeTxn(opts *CascadeOptions, applied []cascadeOp) error {
+	for i := len(applied) - 1; i >= 0; i-- {
+		op := applied[i]
+		coll := opts.Session.DB("").C(op.Collection)
+
+		switch op.Kind {
+		case opSetFields:
+			fields := make([]string, 0, len(op.Fields))
+			for f := range op.Fields {
+				fields = append(fields, f)
+			}
+
+			for docId, prior := range op.priorFieldValues {
+				set := bson.M{}
+				unset := bson.M{}
+
+				for _, f := range fields {
+					if v, ok := prior[f]; ok {
+						set[f] = v
+					} else {
+						unset[f] = 1
+					}
+				}
+
+				update := bson.M{}
+				if len(set) > 0 {
+					update["$set"] = set
+				}
+				if len(unset) > 0 {
+					update["$unset"] = unset
+				}
+
+				if len(update) == 0 {
+					continue
+				}
+
+				if err := coll.UpdateId(docId, update); err != nil {
+					return err
+				}
+			}
+		case opPullSelf:
+			for docId, elem := range op.priorElements {
+				if err := coll.UpdateId(docId, bson.M{"$push": bson.M{op.ThroughProp: elem}}); err != nil {
+					return err
+				}
+			}
+		case opPushSelf:
+			if _, err := coll.UpdateAll(op.Query, bson.M{"$pull": bson.M{op.ThroughProp: bson.M{"_id": op.Id}}}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package bongo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// seenEventRetention bounds how long an exact-duplicate dedupe entry is
+// kept, so CascadeWatcher.seen doesn't grow without bound over a long-lived
+// watch. It only needs to outlive a cursor restart re-delivering the same
+// oplog entry, so a small multiple of a typical Tail timeout is plenty.
+const seenEventRetention = 5 * time.Minute
+
+// CascadeWatcher re-runs a cascade whenever one of its source documents
+// changes outside the current process - a doc saved by another service, a
+// script, or the mongo shell - fixing the silent staleness CascadeSave can't
+// catch on its own since it only runs when *this* process calls it.
+type CascadeWatcher struct {
+	// Debounce is the minimum time between re-propagating changes to the
+	// same document. Events for a document that arrive within the window
+	// after its last propagation are dropped, not deferred: a change made
+	// inside the window is only propagated if a later event for that
+	// document arrives after the window has elapsed.
+	Debounce time.Duration
+
+	// OnCascadePropagated is called after a change successfully re-runs its
+	// cascade.
+	OnCascadePropagated func(doc bson.M, conf *CascadeConfig)
+
+	// OnCascadeError is called when tailing a source or re-running its
+	// cascade fails. The watcher keeps running after an error.
+	OnCascadeError func(err error)
+
+	mu sync.Mutex
+	// seen dedupes the exact same oplog entry (id+revision) being delivered
+	// twice, e.g. by a cursor restart. lastPropagated, keyed by id alone, is
+	// what Debounce actually checks.
+	seen           map[string]time.Time
+	lastPropagated map[bson.ObjectId]time.Time
+	stopCh         chan struct{}
+	wg             sync.WaitGroup
+	started        bool
+}
+
+// NewCascadeWatcher creates a watcher with a 0 debounce window; set Debounce
+// before calling Watch to limit how often the same document is re-propagated.
+func NewCascadeWatcher() *CascadeWatcher {
+	return &CascadeWatcher{
+		seen:           make(map[string]time.Time),
+		lastPropagated: make(map[bson.ObjectId]time.Time),
+		stopCh:         make(chan struct{}),
+	}
+}
+
+// Watch tails sourceCollection (via the oplog on session, the standard way
+// labix.org/v2/mgo observes changes on servers without native change stream
+// support) and re-runs conf's cascade whenever any document in it is
+// inserted or updated. It returns immediately; tailing happens on a
+// background goroutine until Stop is called.
+func (w *CascadeWatcher) Watch(session *mgo.Session, sourceCollection string, conf *CascadeConfig) {
+	w.mu.Lock()
+	w.started = true
+	w.mu.Unlock()
+
+	w.wg.Add(1)
+	go w.tail(session, sourceCollection, conf)
+}
+
+// Stop halts every collection this watcher is tailing and waits for them to
+// exit.
+func (w *CascadeWatcher) Stop() {
+	w.mu.Lock()
+	if !w.started {
+		w.mu.Unlock()
+		return
+	}
+	w.mu.Unlock()
+
+	close(w.stopCh)
+	w.wg.Wait()
+}
+
+func (w *CascadeWatcher) tail(session *mgo.Session, sourceCollection string, conf *CascadeConfig) {
+	defer w.wg.Done()
+
+	source := session.DB("").C(sourceCollection)
+	oplog := session.DB("local").C("oplog.rs")
+	query := oplog.Find(bson.M{"ns": session.DB("").Name + "." + sourceCollection}).LogReplay()
+	iter := query.Tail(5 * time.Second)
+
+	var entry bson.M
+	for {
+		select {
+		case <-w.stopCh:
+			iter.Close()
+			return
+		default:
+		}
+
+		if iter.Next(&entry) {
+			w.handleOplogEntry(source, entry, conf)
+			continue
+		}
+
+		if err := iter.Err(); err != nil {
+			w.handleError(err)
+		}
+
+		if iter.Timeout() {
+			continue
+		}
+
+		// Cursor died (e.g. collection capped rollover); re-open it.
+		iter = query.Tail(5 * time.Second)
+	}
+}
+
+// oplogDocId pulls the affected document's _id out of an oplog entry,
+// regardless of op type: "i" (insert) and "d" (delete) carry it on "o",
+// while "u" (update) carries it on "o2" since "o" there is just the update
+// modifier, not the document.
+func oplogDocId(entry bson.M) (bson.ObjectId, bool) {
+	op, _ := entry["op"].(string)
+
+	var doc bson.M
+	if op == "u" {
+		doc, _ = entry["o2"].(bson.M)
+	} else {
+		doc, _ = entry["o"].(bson.M)
+	}
+
+	id, ok := doc["_id"].(bson.ObjectId)
+	return id, ok
+}
+
+func (w *CascadeWatcher) handleOplogEntry(source *mgo.Collection, entry bson.M, conf *CascadeConfig) {
+	op, _ := entry["op"].(string)
+	if op == "d" {
+		// Nothing to re-cascade from a deleted source document.
+		return
+	}
+
+	id, ok := oplogDocId(entry)
+	if !ok {
+		return
+	}
+
+	revision := fmt.Sprintf("%v", entry["ts"])
+	dedupeKey := id.Hex() + ":" + revision
+
+	w.mu.Lock()
+	now := time.Now()
+
+	if _, ok := w.seen[dedupeKey]; ok {
+		w.mu.Unlock()
+		return
+	}
+	w.seen[dedupeKey] = now
+	pruneSeen(w.seen, now)
+
+	if last, ok := w.lastPropagated[id]; ok && now.Sub(last) < w.Debounce {
+		w.mu.Unlock()
+		return
+	}
+	w.lastPropagated[id] = now
+	w.mu.Unlock()
+
+	// "o" on an update entry is just the modifier ($set, etc.), not the
+	// document, so always re-fetch the current document rather than trying
+	// to reconstruct it from the oplog entry.
+	var doc bson.M
+	if err := source.FindId(id).One(&doc); err != nil {
+		w.handleError(err)
+		return
+	}
+
+	if _, err := cascadeSaveWithConfig(conf, doc); err != nil {
+		w.handleError(err)
+		return
+	}
+
+	if w.OnCascadePropagated != nil {
+		w.OnCascadePropagated(doc, conf)
+	}
+}
+
+// pruneSeen drops dedupe entries older than seenEventRetention so a
+// long-lived watch doesn't grow w.seen without bound. Caller holds w.mu.
+func pruneSeen(seen map[string]time.Time, now time.Time) {
+	for key, at := range seen {
+		if now.Sub(at) > seenEventRetention {
+			delete(seen, key)
+		}
+	}
+}
+
+func (w *CascadeWatcher) handleError(err error) {
+	if w.OnCascadeError != nil {
+		w.OnCascadeError(err)
+	}
+}